@@ -0,0 +1,64 @@
+package measure
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestNamespaceOfDepth(t *testing.T) {
+	cases := []struct {
+		key   string
+		depth int
+		want  string
+	}{
+		{"/blocks/CIQ", 1, "blocks"},
+		{"/blocks/shard1/CIQ", 2, "blocks/shard1"},
+		{"/blocks/shard1/CIQ", 1, "blocks"},
+		{"/blocks", 2, "blocks"},
+	}
+
+	for _, c := range cases {
+		key := datastore.NewKey(c.key)
+		if got := namespaceOfDepth(key, c.depth); got != c.want {
+			t.Errorf("namespaceOfDepth(%q, %d) = %q, want %q", c.key, c.depth, got, c.want)
+		}
+	}
+}
+
+func TestNamespaceAllowList(t *testing.T) {
+	t.Run("empty allow-list permits everything", func(t *testing.T) {
+		a := newNamespaceAllowList(nil)
+		for _, ns := range []string{"blocks", "pins", "dht"} {
+			if got := a.filter(ns); got != ns {
+				t.Errorf("filter(%q) = %q, want unchanged", ns, got)
+			}
+		}
+	})
+
+	t.Run("listed namespaces pass through, others fold to other", func(t *testing.T) {
+		a := newNamespaceAllowList([]string{"blocks", "pins"})
+		if got := a.filter("blocks"); got != "blocks" {
+			t.Errorf("filter(%q) = %q, want %q", "blocks", got, "blocks")
+		}
+		if got := a.filter("dht"); got != otherNamespace {
+			t.Errorf("filter(%q) = %q, want %q", "dht", got, otherNamespace)
+		}
+	})
+}
+
+// TestNewWithLabelsPrefixDepthDisabled checks the PrefixDepth<=0 case called
+// out in LabelOptions: it should disable per-key labeling entirely, rather
+// than e.g. labeling everything under "other" or the empty string via
+// namespaceOfDepth/the allow-list.
+func TestNewWithLabelsPrefixDepthDisabled(t *testing.T) {
+	d := NewWithLabels("measure-labeled-disabled", datastore.NewMapDatastore(), LabelOptions{
+		PrefixDepth: 0,
+	})
+	if d.namespaceFn != nil {
+		t.Fatal("expected namespaceFn to be nil when PrefixDepth <= 0")
+	}
+	if got := d.namespaceOf(datastore.NewKey("/blocks/CIQ")); got != "" {
+		t.Errorf("namespaceOf with labeling disabled = %q, want empty string", got)
+	}
+}
@@ -1,8 +1,8 @@
-// Package measure provides a Datastore wrapper that records metrics
-// using github.com/whyrusleeping/go-metrics.
+// Package measure provides a Datastore wrapper that records metrics.
 package measure
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"time"
@@ -10,6 +10,8 @@ import (
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
 	"github.com/whyrusleeping/go-metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -17,64 +19,79 @@ const (
 	defaultAlpha         = 0.015
 )
 
+// recorder is the metrics-backend abstraction shared by measure and
+// measuredBatch. Each supported backend (whyrusleeping/go-metrics for New,
+// Prometheus for NewWithRegisterer and NewWithLabels) implements it so the
+// rest of this file can stay backend-agnostic.
+//
+// record and recordBatch take the ctx the operation ran under so that an
+// op whose context was cancelled before it completed can be counted
+// separately instead of skewing latency percentiles with a measurement
+// that doesn't reflect normal completion, and so that the Prometheus-backed
+// recorders (see observeWithExemplar in prometheus.go) can attach the
+// in-flight span's trace id to the latency observation as an exemplar when
+// one is available. namespace is the label computed by NewWithLabels (see
+// namespaceFn); backends that don't support per-namespace breakdowns
+// ignore it.
+type recorder interface {
+	// record accounts a single completed op: how long it took and whether
+	// it returned an error.
+	record(ctx context.Context, op, namespace string, elapsed time.Duration, err error)
+	// recordSize records a value-size observation (in bytes) for op.
+	recordSize(op, namespace string, size int)
+	// recordBatch accounts n operations of op committed together in
+	// elapsed time total, with err the single result of the commit.
+	recordBatch(ctx context.Context, op, namespace string, n int, elapsed time.Duration, err error)
+	// recordDiskUsage sets the disk.usage.bytes gauge to bytes, as sampled
+	// on the most recent successful DiskUsage call.
+	recordDiskUsage(bytes uint64)
+
+	// recordTxnOpen accounts a NewTransaction call.
+	recordTxnOpen()
+	// recordTxnCommit accounts a Txn.Commit: commitElapsed is how long the
+	// Commit call itself took, totalElapsed is open-to-close (since
+	// NewTransaction).
+	recordTxnCommit(commitElapsed, totalElapsed time.Duration, err error)
+	// recordTxnDiscard accounts a Txn.Discard; totalElapsed is open-to-close.
+	recordTxnDiscard(totalElapsed time.Duration)
+	// recordTxnOp and recordTxnOpSize are the txn-scoped counterparts of
+	// record and recordSize, for operations performed through a Txn
+	// returned by NewTransaction.
+	recordTxnOp(ctx context.Context, op string, elapsed time.Duration, err error)
+	recordTxnOpSize(op string, size int)
+
+	close() error
+}
+
 // New wraps the datastore, providing metrics on the operations. The
 // metrics are registered with names starting with prefix and a dot.
 //
 // If prefix is not unique, New will panic. Call Close to release the
 // prefix.
 func New(prefix string, ds datastore.Datastore) *measure {
-	m := &measure{
+	return &measure{
 		backend: ds,
-
-		putCount:   registerCounter(prefix + ".put.count"),
-		putErr:     registerCounter(prefix + ".put.err"),
-		putLatency: registerHistogram(prefix + ".put.latency"),
-		putSize:    registerHistogram(prefix + ".put.size"),
-
-		getCount:   registerCounter(prefix + ".get.count"),
-		getErr:     registerCounter(prefix + ".get.err"),
-		getLatency: registerHistogram(prefix + ".get.latency"),
-		getSize:    registerHistogram(prefix + ".get.size"),
-
-		hasCount:   registerCounter(prefix + ".has.count"),
-		hasErr:     registerCounter(prefix + ".has.err"),
-		hasLatency: registerHistogram(prefix + ".has.latency"),
-
-		deleteCount:   registerCounter(prefix + ".delete.count"),
-		deleteErr:     registerCounter(prefix + ".delete.err"),
-		deleteLatency: registerHistogram(prefix + ".delete.latency"),
-
-		queryCount:   registerCounter(prefix + ".query.count"),
-		queryErr:     registerCounter(prefix + ".query.err"),
-		queryLatency: registerHistogram(prefix + ".query.latency"),
+		rec:     newGoMetricsRecorder(prefix),
 	}
-	return m
 }
 
 type measure struct {
 	backend datastore.Datastore
+	rec     recorder
+	tracer  trace.Tracer // nil unless constructed with NewWithTracer
 
-	putCount   namedCounter
-	putErr     namedCounter
-	putLatency namedHistogram
-	putSize    namedHistogram
-
-	getCount   namedCounter
-	getErr     namedCounter
-	getLatency namedHistogram
-	getSize    namedHistogram
-
-	hasCount   namedCounter
-	hasErr     namedCounter
-	hasLatency namedHistogram
-
-	deleteCount   namedCounter
-	deleteErr     namedCounter
-	deleteLatency namedHistogram
+	// namespaceFn derives the "namespace" label from a key; nil unless
+	// constructed with NewWithLabels with a positive PrefixDepth.
+	namespaceFn func(datastore.Key) string
+}
 
-	queryCount   namedCounter
-	queryErr     namedCounter
-	queryLatency namedHistogram
+// namespaceOf returns the namespace label for key, or "" if m wasn't
+// constructed with NewWithLabels.
+func (m *measure) namespaceOf(key datastore.Key) string {
+	if m.namespaceFn == nil {
+		return ""
+	}
+	return m.namespaceFn(key)
 }
 
 type namedCounter struct {
@@ -104,165 +121,362 @@ func registerHistogram(name string) namedHistogram {
 	return namedHistogram{name, hist}
 }
 
-func recordLatency(h namedHistogram, start time.Time) {
-	elapsed := time.Now().Sub(start) / time.Microsecond
-	h.Update(int64(elapsed))
+// goMetricsOp holds the metrics registered for a single operation (put,
+// get, has, ...).
+type goMetricsOp struct {
+	count     namedCounter
+	err       namedCounter
+	cancelled namedCounter
+	latency   namedHistogram
+	size      namedHistogram // zero value if this op doesn't track size
+}
+
+// goMetricsRecorder is the original recorder backend, built on
+// github.com/whyrusleeping/go-metrics and its process-wide registry.
+type goMetricsRecorder struct {
+	ops       map[string]*goMetricsOp
+	diskUsage namedGauge
+
+	// txnOps holds the txn-scoped counterparts of ops (e.g. "put" here
+	// tracks prefix+".put.txn.count", distinct from ops["put"]'s
+	// prefix+".put.count"), so operations performed through a Txn are
+	// counted separately from top-level ones.
+	txnOps map[string]*goMetricsOp
+
+	txnCount         namedCounter
+	txnCommitCount   namedCounter
+	txnCommitErr     namedCounter
+	txnCommitLatency namedHistogram
+	txnDiscardCount  namedCounter
+	txnDuration      namedHistogram
+}
+
+type namedGauge struct {
+	name string
+	metrics.Gauge
+}
+
+func registerGauge(name string) namedGauge {
+	gauge := metrics.NewGauge()
+	if err := metrics.Register(name, gauge); err != nil {
+		panic(fmt.Sprintf("duplicate metric \"%s\"", name))
+	}
+	return namedGauge{name, gauge}
+}
+
+func registerOp(prefix, op string, withSize bool) *goMetricsOp {
+	o := &goMetricsOp{
+		count:     registerCounter(prefix + "." + op + ".count"),
+		err:       registerCounter(prefix + "." + op + ".err"),
+		cancelled: registerCounter(prefix + "." + op + ".cancelled"),
+		latency:   registerHistogram(prefix + "." + op + ".latency"),
+	}
+	if withSize {
+		o.size = registerHistogram(prefix + "." + op + ".size")
+	}
+	return o
 }
 
-func (m *measure) Put(key datastore.Key, value interface{}) error {
-	defer recordLatency(m.putLatency, time.Now())
-	m.putCount.Inc(1)
-	if b, ok := value.([]byte); ok {
-		m.putSize.Update(int64(len(b)))
+func newGoMetricsRecorder(prefix string) *goMetricsRecorder {
+	return &goMetricsRecorder{
+		ops: map[string]*goMetricsOp{
+			"put":     registerOp(prefix, "put", true),
+			"get":     registerOp(prefix, "get", true),
+			"has":     registerOp(prefix, "has", false),
+			"delete":  registerOp(prefix, "delete", false),
+			"query":   registerOp(prefix, "query", false),
+			"getsize": registerOp(prefix, "getsize", false),
+			"sync":    registerOp(prefix, "sync", false),
+		},
+		diskUsage: registerGauge(prefix + ".disk.usage.bytes"),
+
+		txnOps: map[string]*goMetricsOp{
+			"put":     registerOp(prefix, "put.txn", true),
+			"get":     registerOp(prefix, "get.txn", true),
+			"has":     registerOp(prefix, "has.txn", false),
+			"delete":  registerOp(prefix, "delete.txn", false),
+			"query":   registerOp(prefix, "query.txn", false),
+			"getsize": registerOp(prefix, "getsize.txn", false),
+		},
+		txnCount:         registerCounter(prefix + ".txn.count"),
+		txnCommitCount:   registerCounter(prefix + ".txn.commit.count"),
+		txnCommitErr:     registerCounter(prefix + ".txn.commit.err"),
+		txnCommitLatency: registerHistogram(prefix + ".txn.commit.latency"),
+		txnDiscardCount:  registerCounter(prefix + ".txn.discard.count"),
+		txnDuration:      registerHistogram(prefix + ".txn.duration"),
 	}
-	err := m.backend.Put(key, value)
+}
+
+func (r *goMetricsRecorder) op(op string) *goMetricsOp {
+	o, ok := r.ops[op]
+	if !ok {
+		panic(fmt.Sprintf("measure: unknown op %q", op))
+	}
+	return o
+}
+
+func (r *goMetricsRecorder) record(ctx context.Context, op, _ string, elapsed time.Duration, err error) {
+	o := r.op(op)
+	if ctx.Err() != nil {
+		o.cancelled.Inc(1)
+		return
+	}
+	o.count.Inc(1)
 	if err != nil {
-		m.putErr.Inc(1)
+		o.err.Inc(1)
+	}
+	o.latency.Update(int64(elapsed / time.Microsecond))
+}
+
+func (r *goMetricsRecorder) recordSize(op, _ string, size int) {
+	if o, ok := r.ops[op]; ok && o.size.Histogram != nil {
+		o.size.Update(int64(size))
 	}
-	return err
 }
 
-func (m *measure) Get(key datastore.Key) (value interface{}, err error) {
-	defer recordLatency(m.getLatency, time.Now())
-	m.getCount.Inc(1)
-	value, err = m.backend.Get(key)
+func (r *goMetricsRecorder) recordBatch(ctx context.Context, op, _ string, n int, elapsed time.Duration, err error) {
+	if n == 0 {
+		return
+	}
+	o := r.op(op)
+	if ctx.Err() != nil {
+		o.cancelled.Inc(int64(n))
+		return
+	}
+	o.count.Inc(int64(n))
+	took := int64(elapsed/time.Microsecond) / int64(n)
+	for i := 0; i < n; i++ {
+		o.latency.Update(took)
+	}
 	if err != nil {
-		m.getErr.Inc(1)
-	} else {
-		if b, ok := value.([]byte); ok {
-			m.getSize.Update(int64(len(b)))
-		}
+		o.err.Inc(1)
 	}
-	return value, err
 }
 
-func (m *measure) Has(key datastore.Key) (exists bool, err error) {
-	defer recordLatency(m.hasLatency, time.Now())
-	m.hasCount.Inc(1)
-	exists, err = m.backend.Has(key)
+func (r *goMetricsRecorder) recordDiskUsage(bytes uint64) {
+	r.diskUsage.Update(int64(bytes))
+}
+
+func (r *goMetricsRecorder) recordTxnOpen() {
+	r.txnCount.Inc(1)
+}
+
+func (r *goMetricsRecorder) recordTxnCommit(commitElapsed, totalElapsed time.Duration, err error) {
+	r.txnCommitCount.Inc(1)
 	if err != nil {
-		m.hasErr.Inc(1)
+		r.txnCommitErr.Inc(1)
 	}
-	return exists, err
+	r.txnCommitLatency.Update(int64(commitElapsed / time.Microsecond))
+	r.txnDuration.Update(int64(totalElapsed / time.Microsecond))
+}
+
+func (r *goMetricsRecorder) recordTxnDiscard(totalElapsed time.Duration) {
+	r.txnDiscardCount.Inc(1)
+	r.txnDuration.Update(int64(totalElapsed / time.Microsecond))
 }
 
-func (m *measure) Delete(key datastore.Key) error {
-	defer recordLatency(m.deleteLatency, time.Now())
-	m.deleteCount.Inc(1)
-	err := m.backend.Delete(key)
+func (r *goMetricsRecorder) recordTxnOp(ctx context.Context, op string, elapsed time.Duration, err error) {
+	o, ok := r.txnOps[op]
+	if !ok {
+		return
+	}
+	if ctx.Err() != nil {
+		o.cancelled.Inc(1)
+		return
+	}
+	o.count.Inc(1)
 	if err != nil {
-		m.deleteErr.Inc(1)
+		o.err.Inc(1)
+	}
+	o.latency.Update(int64(elapsed / time.Microsecond))
+}
+
+func (r *goMetricsRecorder) recordTxnOpSize(op string, size int) {
+	if o, ok := r.txnOps[op]; ok && o.size.Histogram != nil {
+		o.size.Update(int64(size))
 	}
+}
+
+func (r *goMetricsRecorder) close() error {
+	for _, o := range r.ops {
+		metrics.Unregister(o.count.name)
+		metrics.Unregister(o.err.name)
+		metrics.Unregister(o.cancelled.name)
+		metrics.Unregister(o.latency.name)
+		if o.size.Histogram != nil {
+			metrics.Unregister(o.size.name)
+		}
+	}
+	for _, o := range r.txnOps {
+		metrics.Unregister(o.count.name)
+		metrics.Unregister(o.err.name)
+		metrics.Unregister(o.cancelled.name)
+		metrics.Unregister(o.latency.name)
+		if o.size.Histogram != nil {
+			metrics.Unregister(o.size.name)
+		}
+	}
+	metrics.Unregister(r.diskUsage.name)
+	metrics.Unregister(r.txnCount.name)
+	metrics.Unregister(r.txnCommitCount.name)
+	metrics.Unregister(r.txnCommitErr.name)
+	metrics.Unregister(r.txnCommitLatency.name)
+	metrics.Unregister(r.txnDiscardCount.name)
+	metrics.Unregister(r.txnDuration.name)
+	return nil
+}
+
+func (m *measure) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	ctx, span := m.startSpan(ctx, "Put",
+		attribute.String("ds.key.namespace", key.BaseNamespace()),
+		attribute.Int("ds.value.size", len(value)),
+	)
+	ns := m.namespaceOf(key)
+	start := time.Now()
+	m.rec.recordSize("put", ns, len(value))
+	err := m.backend.Put(ctx, key, value)
+	m.rec.record(ctx, "put", ns, time.Since(start), err)
+	finishSpan(span, err)
 	return err
 }
 
-func (m *measure) Query(q query.Query) (query.Results, error) {
-	defer recordLatency(m.queryLatency, time.Now())
-	m.queryCount.Inc(1)
-	res, err := m.backend.Query(q)
-	if err != nil {
-		m.queryErr.Inc(1)
+func (m *measure) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
+	ctx, span := m.startSpan(ctx, "Get", attribute.String("ds.key.namespace", key.BaseNamespace()))
+	ns := m.namespaceOf(key)
+	start := time.Now()
+	value, err = m.backend.Get(ctx, key)
+	if err == nil {
+		m.rec.recordSize("get", ns, len(value))
 	}
+	m.rec.record(ctx, "get", ns, time.Since(start), err)
+	finishSpan(span, err)
+	return value, err
+}
+
+func (m *measure) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
+	ctx, span := m.startSpan(ctx, "Has", attribute.String("ds.key.namespace", key.BaseNamespace()))
+	start := time.Now()
+	exists, err = m.backend.Has(ctx, key)
+	m.rec.record(ctx, "has", m.namespaceOf(key), time.Since(start), err)
+	finishSpan(span, err)
+	return exists, err
+}
+
+func (m *measure) Delete(ctx context.Context, key datastore.Key) error {
+	ctx, span := m.startSpan(ctx, "Delete", attribute.String("ds.key.namespace", key.BaseNamespace()))
+	start := time.Now()
+	err := m.backend.Delete(ctx, key)
+	m.rec.record(ctx, "delete", m.namespaceOf(key), time.Since(start), err)
+	finishSpan(span, err)
+	return err
+}
+
+func (m *measure) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	ctx, span := m.startSpan(ctx, "Query", attribute.String("ds.query.prefix", q.Prefix))
+	start := time.Now()
+	res, err := m.backend.Query(ctx, q)
+	m.rec.record(ctx, "query", m.namespaceOf(datastore.NewKey(q.Prefix)), time.Since(start), err)
+	finishSpan(span, err)
 	return res, err
 }
 
+func (m *measure) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	ctx, span := m.startSpan(ctx, "GetSize", attribute.String("ds.key.namespace", key.BaseNamespace()))
+	start := time.Now()
+	size, err := m.backend.GetSize(ctx, key)
+	m.rec.record(ctx, "getsize", m.namespaceOf(key), time.Since(start), err)
+	finishSpan(span, err)
+	return size, err
+}
+
+func (m *measure) Sync(ctx context.Context, prefix datastore.Key) error {
+	ctx, span := m.startSpan(ctx, "Sync", attribute.String("ds.key.namespace", prefix.BaseNamespace()))
+	start := time.Now()
+	err := m.backend.Sync(ctx, prefix)
+	m.rec.record(ctx, "sync", m.namespaceOf(prefix), time.Since(start), err)
+	finishSpan(span, err)
+	return err
+}
+
+// DiskUsage implements datastore.PersistentDatastore, forwarding to the
+// backend and sampling the result into the disk.usage.bytes gauge. It
+// returns 0, nil if the backend doesn't implement PersistentDatastore,
+// matching the behavior of the datastore.DiskUsage helper.
+func (m *measure) DiskUsage(ctx context.Context) (uint64, error) {
+	persistent, ok := m.backend.(datastore.PersistentDatastore)
+	if !ok {
+		return 0, nil
+	}
+
+	ctx, span := m.startSpan(ctx, "DiskUsage")
+	usage, err := persistent.DiskUsage(ctx)
+	if err == nil {
+		m.rec.recordDiskUsage(usage)
+	}
+	finishSpan(span, err)
+	return usage, err
+}
+
+// measuredBatch wraps a single underlying datastore.Batch. Put and Delete
+// calls are forwarded to it in the order they were received so that Commit
+// reproduces the caller's actual sequence of operations instead of
+// reordering puts and deletes relative to each other.
 type measuredBatch struct {
 	puts    int
 	deletes int
 
-	putts datastore.Batch
-	delts datastore.Batch
+	batch datastore.Batch
 
 	m *measure
 }
 
-func (m *measure) Batch() (datastore.Batch, error) {
+func (m *measure) Batch(ctx context.Context) (datastore.Batch, error) {
 	bds, ok := m.backend.(datastore.Batching)
 	if !ok {
 		return nil, datastore.ErrBatchUnsupported
 	}
-	pb, err := bds.Batch()
-	if err != nil {
-		return nil, err
-	}
-
-	db, err := bds.Batch()
+	b, err := bds.Batch(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	return &measuredBatch{
-		putts: pb,
-		delts: db,
+		batch: b,
 
 		m: m,
 	}, nil
 }
 
-func (mt *measuredBatch) Put(key datastore.Key, val interface{}) error {
+func (mt *measuredBatch) Put(ctx context.Context, key datastore.Key, val []byte) error {
 	mt.puts++
-	valb, ok := val.([]byte)
-	if ok {
-		mt.m.putSize.Update(int64(len(valb)))
-	}
-	return mt.putts.Put(key, val)
+	mt.m.rec.recordSize("put", mt.m.namespaceOf(key), len(val))
+	return mt.batch.Put(ctx, key, val)
 }
 
-func (mt *measuredBatch) Delete(key datastore.Key) error {
+func (mt *measuredBatch) Delete(ctx context.Context, key datastore.Key) error {
 	mt.deletes++
-	return mt.delts.Delete(key)
+	return mt.batch.Delete(ctx, key)
 }
 
-func (mt *measuredBatch) Commit() error {
-	err := logBatchCommit(mt.delts, mt.deletes, mt.m.deleteCount, mt.m.deleteErr, mt.m.deleteLatency)
-	if err != nil {
-		return err
-	}
-
-	err = logBatchCommit(mt.putts, mt.puts, mt.m.putCount, mt.m.putErr, mt.m.putLatency)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func logBatchCommit(b datastore.Batch, n int, num, errs metrics.Counter, lat namedHistogram) error {
-	if n > 0 {
-		before := time.Now()
-		err := b.Commit()
-		took := int(time.Now().Sub(before)/time.Microsecond) / n
-		num.Inc(int64(n))
-		for i := 0; i < n; i++ {
-			lat.Update(int64(took))
-		}
-		if err != nil {
-			errs.Inc(1)
-			return err
-		}
-	}
-	return nil
+func (mt *measuredBatch) Commit(ctx context.Context) error {
+	ctx, span := mt.m.startSpan(ctx, "Batch.Commit",
+		attribute.Int("ds.batch.puts", mt.puts),
+		attribute.Int("ds.batch.deletes", mt.deletes),
+	)
+
+	before := time.Now()
+	err := mt.batch.Commit(ctx)
+	elapsed := time.Since(before)
+	mt.m.rec.recordBatch(ctx, "put", "", mt.puts, elapsed, err)
+	mt.m.rec.recordBatch(ctx, "delete", "", mt.deletes, elapsed, err)
+	finishSpan(span, err)
+	return err
 }
 
 func (m *measure) Close() error {
-	metrics.Unregister(m.putCount.name)
-	metrics.Unregister(m.putErr.name)
-	metrics.Unregister(m.putLatency.name)
-	metrics.Unregister(m.putSize.name)
-	metrics.Unregister(m.getCount.name)
-	metrics.Unregister(m.getErr.name)
-	metrics.Unregister(m.getLatency.name)
-	metrics.Unregister(m.getSize.name)
-	metrics.Unregister(m.hasCount.name)
-	metrics.Unregister(m.hasErr.name)
-	metrics.Unregister(m.hasLatency.name)
-	metrics.Unregister(m.deleteCount.name)
-	metrics.Unregister(m.deleteErr.name)
-	metrics.Unregister(m.deleteLatency.name)
-	metrics.Unregister(m.queryCount.name)
-	metrics.Unregister(m.queryErr.name)
-	metrics.Unregister(m.queryLatency.name)
-
+	if err := m.rec.close(); err != nil {
+		return err
+	}
 	if c, ok := m.backend.(io.Closer); ok {
 		return c.Close()
 	}
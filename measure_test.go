@@ -1,12 +1,91 @@
 package measure
 
 import (
+	"context"
 	"testing"
 
+	"github.com/ipfs/go-datastore"
 	dstest "github.com/ipfs/go-datastore/test"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestSuite(t *testing.T) {
 	d := New("measure", dstest.NewTestDatastore(false))
 	dstest.SubtestAll(t, d)
 }
+
+func TestPrometheusSuite(t *testing.T) {
+	d := NewWithRegisterer("measure", dstest.NewTestDatastore(false), prometheus.NewRegistry())
+	dstest.SubtestAll(t, d)
+}
+
+func TestTracerSuite(t *testing.T) {
+	d := NewWithTracer("measure-tracer", dstest.NewTestDatastore(false), trace.NewNoopTracerProvider().Tracer("measure"))
+	dstest.SubtestAll(t, d)
+}
+
+func TestLabeledSuite(t *testing.T) {
+	d := NewWithLabels("measure-labeled", dstest.NewTestDatastore(false), LabelOptions{
+		PrefixDepth: 1,
+		Namespaces:  []string{"a", "b"},
+		Registerer:  prometheus.NewRegistry(),
+	})
+	dstest.SubtestAll(t, d)
+}
+
+// fakeTxnDatastore is a minimal datastore.TxnDatastore: every transaction
+// operates directly on the same backing MapDatastore, with no isolation
+// or atomicity. That's fine here since it only exists to be wrapped by
+// measure in TestTxn.
+type fakeTxnDatastore struct {
+	*datastore.MapDatastore
+}
+
+func newFakeTxnDatastore() *fakeTxnDatastore {
+	return &fakeTxnDatastore{datastore.NewMapDatastore()}
+}
+
+func (d *fakeTxnDatastore) NewTransaction(ctx context.Context, readOnly bool) (datastore.Txn, error) {
+	return &fakeTxn{d.MapDatastore}, nil
+}
+
+type fakeTxn struct {
+	*datastore.MapDatastore
+}
+
+func (t *fakeTxn) Commit(ctx context.Context) error { return nil }
+func (t *fakeTxn) Discard(ctx context.Context)      {}
+
+func TestTxn(t *testing.T) {
+	ctx := context.Background()
+	d := New("measure-txn", newFakeTxnDatastore())
+
+	txn, err := d.NewTransaction(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := datastore.NewKey("a")
+	if err := txn.Put(ctx, k, []byte("b")); err != nil {
+		t.Fatal("error putting through transaction: ", err)
+	}
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatal("error committing transaction: ", err)
+	}
+
+	have, err := d.Has(ctx, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !have {
+		t.Fatal("expected key put through the transaction to be visible after commit")
+	}
+}
+
+func TestTxnUnsupported(t *testing.T) {
+	d := New("measure-txn-unsupported", dstest.NewTestDatastore(false))
+	if _, err := d.NewTransaction(context.Background(), false); err != ErrTxnUnsupported {
+		t.Fatalf("expected ErrTxnUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,322 @@
+package measure
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewWithRegisterer is like New, but records metrics as Prometheus
+// collectors registered with reg instead of using the whyrusleeping/go-metrics
+// global registry. This makes the wrapper directly scrapable by
+// Prometheus (or anything else speaking the OpenMetrics exposition format,
+// e.g. via PrometheusHandler) and, since registration is scoped to reg
+// rather than a single process-wide namespace, lets callers run more than
+// one measure instance per process without the duplicate-registration
+// panic that New is prone to: just pass each instance its own
+// prometheus.Registry.
+//
+// The prefix is sanitized into a metric name component (see
+// sanitizeMetricName) and used to name three collectors shared by every
+// operation: the <prefix>_requests_total counter, labeled by op and
+// whether it errored; the <prefix>_request_duration_seconds histogram,
+// labeled by op; and the <prefix>_request_size_bytes histogram, labeled by
+// op. There is no separate <prefix>_put_total-style counter per
+// operation — "put", "get", etc. are label values on those three
+// collectors, not metric name components.
+func NewWithRegisterer(prefix string, ds datastore.Datastore, reg prometheus.Registerer) *measure {
+	return &measure{
+		backend: ds,
+		rec:     newPrometheusRecorder(prefix, reg),
+	}
+}
+
+// PrometheusHandler returns an http.Handler that serves metrics registered
+// with prometheus.DefaultRegisterer (the registerer NewWithRegisterer uses
+// if the caller doesn't maintain a dedicated prometheus.Registry) in
+// Prometheus/OpenMetrics exposition format. OpenMetrics is enabled
+// explicitly (rather than via promhttp.Handler) so that the trace-id
+// exemplars attached by observeWithExemplar are actually exposed to the
+// scraper.
+func PrometheusHandler() http.Handler {
+	return promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
+
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+var leadingDigit = regexp.MustCompile(`^[0-9]`)
+
+// sanitizeMetricName rewrites prefix into a valid Prometheus metric name
+// component, since datastore mount prefixes (e.g. "/blockstore", or a
+// numeric shard/mount id like "0") aren't themselves legal Prometheus
+// identifiers: besides disallowed characters, Prometheus also requires the
+// name not start with a digit.
+func sanitizeMetricName(prefix string) string {
+	name := invalidMetricChars.ReplaceAllString(prefix, "_")
+	if name == "" {
+		return "measure"
+	}
+	if leadingDigit.MatchString(name) {
+		name = "_" + name
+	}
+	return name
+}
+
+// txnMetrics is the Prometheus collector set for transaction-scoped
+// metrics (NewTransaction), shared by prometheusRecorder and
+// labeledPrometheusRecorder since neither breaks transactions down by
+// key namespace.
+type txnMetrics struct {
+	requests *prometheus.CounterVec   // labels: op, error
+	latency  *prometheus.HistogramVec // labels: op
+	size     *prometheus.HistogramVec // labels: op
+
+	count         prometheus.Counter
+	commitCount   prometheus.Counter
+	commitErr     prometheus.Counter
+	commitLatency prometheus.Histogram
+	discardCount  prometheus.Counter
+	duration      prometheus.Histogram
+}
+
+func newTxnMetrics(name string) *txnMetrics {
+	return &txnMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: name + "_txn_requests_total",
+			Help: "Number of datastore operations performed inside a transaction, by operation and whether it errored.",
+		}, []string{"op", "error"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    name + "_txn_request_duration_seconds",
+			Help:    "Latency in seconds of datastore operations performed inside a transaction, by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"op"}),
+		size: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    name + "_txn_request_size_bytes",
+			Help:    "Size in bytes of values put or retrieved inside a transaction, by operation.",
+			Buckets: prometheus.ExponentialBuckets(64, 2, 16),
+		}, []string{"op"}),
+		count: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: name + "_txn_total",
+			Help: "Number of transactions opened via NewTransaction.",
+		}),
+		commitCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: name + "_txn_commit_total",
+			Help: "Number of transaction commits attempted.",
+		}),
+		commitErr: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: name + "_txn_commit_errors_total",
+			Help: "Number of transaction commits that returned an error.",
+		}),
+		commitLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    name + "_txn_commit_duration_seconds",
+			Help:    "Latency in seconds of the Commit call itself.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		discardCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: name + "_txn_discard_total",
+			Help: "Number of transactions discarded.",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    name + "_txn_duration_seconds",
+			Help:    "Open-to-close duration in seconds of a transaction, whether committed or discarded.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+}
+
+func (t *txnMetrics) mustRegister(reg prometheus.Registerer) {
+	reg.MustRegister(t.requests, t.latency, t.size, t.count, t.commitCount, t.commitErr, t.commitLatency, t.discardCount, t.duration)
+}
+
+func (t *txnMetrics) unregister(reg prometheus.Registerer) {
+	reg.Unregister(t.requests)
+	reg.Unregister(t.latency)
+	reg.Unregister(t.size)
+	reg.Unregister(t.count)
+	reg.Unregister(t.commitCount)
+	reg.Unregister(t.commitErr)
+	reg.Unregister(t.commitLatency)
+	reg.Unregister(t.discardCount)
+	reg.Unregister(t.duration)
+}
+
+func (t *txnMetrics) recordTxnOpen() {
+	t.count.Inc()
+}
+
+func (t *txnMetrics) recordTxnCommit(commitElapsed, totalElapsed time.Duration, err error) {
+	t.commitCount.Inc()
+	if err != nil {
+		t.commitErr.Inc()
+	}
+	t.commitLatency.Observe(commitElapsed.Seconds())
+	t.duration.Observe(totalElapsed.Seconds())
+}
+
+func (t *txnMetrics) recordTxnDiscard(totalElapsed time.Duration) {
+	t.discardCount.Inc()
+	t.duration.Observe(totalElapsed.Seconds())
+}
+
+func (t *txnMetrics) recordTxnOp(ctx context.Context, op string, elapsed time.Duration, err error) {
+	label := errLabel(ctx, err)
+	t.requests.WithLabelValues(op, label).Inc()
+	if label != "cancelled" {
+		observeWithExemplar(t.latency.WithLabelValues(op), ctx, elapsed.Seconds())
+	}
+}
+
+func (t *txnMetrics) recordTxnOpSize(op string, size int) {
+	t.size.WithLabelValues(op).Observe(float64(size))
+}
+
+// prometheusRecorder is the Prometheus-backed recorder used by
+// NewWithRegisterer.
+type prometheusRecorder struct {
+	reg prometheus.Registerer
+
+	requests  *prometheus.CounterVec
+	latency   *prometheus.HistogramVec
+	size      *prometheus.HistogramVec
+	diskUsage prometheus.Gauge
+
+	txn *txnMetrics
+}
+
+func newPrometheusRecorder(prefix string, reg prometheus.Registerer) *prometheusRecorder {
+	name := sanitizeMetricName(prefix)
+
+	r := &prometheusRecorder{
+		reg: reg,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: name + "_requests_total",
+			Help: "Number of datastore operations performed, by operation and whether it errored.",
+		}, []string{"op", "error"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    name + "_request_duration_seconds",
+			Help:    "Datastore operation latency in seconds, by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"op"}),
+		size: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    name + "_request_size_bytes",
+			Help:    "Size in bytes of values passed to Put or returned by Get, by operation.",
+			Buckets: prometheus.ExponentialBuckets(64, 2, 16),
+		}, []string{"op"}),
+		diskUsage: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: name + "_disk_usage_bytes",
+			Help: "Disk space used by the datastore, in bytes, as of the most recent DiskUsage call.",
+		}),
+		txn: newTxnMetrics(name),
+	}
+
+	reg.MustRegister(r.requests, r.latency, r.size, r.diskUsage)
+	r.txn.mustRegister(reg)
+
+	return r
+}
+
+// errLabel reports the "error" label value for a completed op: "true" or
+// "false", or "cancelled" when the op's context was cancelled (or timed
+// out) before it finished, so a cancelled op's incomplete latency doesn't
+// get folded in with normal completions.
+func errLabel(ctx context.Context, err error) string {
+	if ctx.Err() != nil {
+		return "cancelled"
+	}
+	if err != nil {
+		return "true"
+	}
+	return "false"
+}
+
+// exemplarLabels returns the OpenMetrics exemplar labels to attach to a
+// latency observation taken under ctx, or nil if ctx doesn't carry a
+// sampled span (e.g. no tracer is configured, or the caller's own tracer
+// decided not to sample). This is independent of NewWithTracer: it picks
+// up whatever span, ours or the caller's, is already on the context, so a
+// Prometheus/Thanos exemplar can point an operator straight at the trace
+// for a slow bucket.
+func exemplarLabels(ctx context.Context) prometheus.Labels {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsSampled() {
+		return nil
+	}
+	return prometheus.Labels{"trace_id": sc.TraceID().String()}
+}
+
+// observeWithExemplar records seconds on hist, attaching the trace id from
+// ctx as an exemplar when one is available so operators can jump from a
+// latency spike straight to the trace that caused it.
+func observeWithExemplar(hist prometheus.Observer, ctx context.Context, seconds float64) {
+	labels := exemplarLabels(ctx)
+	if labels == nil {
+		hist.Observe(seconds)
+		return
+	}
+	hist.(prometheus.ExemplarObserver).ObserveWithExemplar(seconds, labels)
+}
+
+func (r *prometheusRecorder) record(ctx context.Context, op, _ string, elapsed time.Duration, err error) {
+	label := errLabel(ctx, err)
+	r.requests.WithLabelValues(op, label).Inc()
+	if label != "cancelled" {
+		observeWithExemplar(r.latency.WithLabelValues(op), ctx, elapsed.Seconds())
+	}
+}
+
+func (r *prometheusRecorder) recordSize(op, _ string, size int) {
+	r.size.WithLabelValues(op).Observe(float64(size))
+}
+
+func (r *prometheusRecorder) recordBatch(ctx context.Context, op, _ string, n int, elapsed time.Duration, err error) {
+	if n == 0 {
+		return
+	}
+	label := errLabel(ctx, err)
+	r.requests.WithLabelValues(op, label).Add(float64(n))
+	if label == "cancelled" {
+		return
+	}
+	perOp := elapsed / time.Duration(n)
+	for i := 0; i < n; i++ {
+		observeWithExemplar(r.latency.WithLabelValues(op), ctx, perOp.Seconds())
+	}
+}
+
+func (r *prometheusRecorder) recordDiskUsage(bytes uint64) {
+	r.diskUsage.Set(float64(bytes))
+}
+
+func (r *prometheusRecorder) recordTxnOpen() {
+	r.txn.recordTxnOpen()
+}
+
+func (r *prometheusRecorder) recordTxnCommit(commitElapsed, totalElapsed time.Duration, err error) {
+	r.txn.recordTxnCommit(commitElapsed, totalElapsed, err)
+}
+
+func (r *prometheusRecorder) recordTxnDiscard(totalElapsed time.Duration) {
+	r.txn.recordTxnDiscard(totalElapsed)
+}
+
+func (r *prometheusRecorder) recordTxnOp(ctx context.Context, op string, elapsed time.Duration, err error) {
+	r.txn.recordTxnOp(ctx, op, elapsed, err)
+}
+
+func (r *prometheusRecorder) recordTxnOpSize(op string, size int) {
+	r.txn.recordTxnOpSize(op, size)
+}
+
+func (r *prometheusRecorder) close() error {
+	r.reg.Unregister(r.requests)
+	r.reg.Unregister(r.latency)
+	r.reg.Unregister(r.size)
+	r.reg.Unregister(r.diskUsage)
+	r.txn.unregister(r.reg)
+	return nil
+}
@@ -0,0 +1,117 @@
+package measure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSanitizeMetricName(t *testing.T) {
+	cases := []struct {
+		prefix string
+		want   string
+	}{
+		{"measure", "measure"},
+		{"/blockstore", "_blockstore"},
+		{"0", "_0"},
+		{"0-shard", "_0_shard"},
+		{"", "measure"},
+		{"!!!", "___"},
+	}
+
+	for _, c := range cases {
+		if got := sanitizeMetricName(c.prefix); got != c.want {
+			t.Errorf("sanitizeMetricName(%q) = %q, want %q", c.prefix, got, c.want)
+		}
+	}
+}
+
+// TestNewWithRegistererDigitLeadingPrefix guards against the panic a
+// digit-leading prefix (e.g. a numeric shard/mount id) used to cause inside
+// MustRegister, since "0_requests_total" isn't a valid Prometheus metric
+// name.
+func TestNewWithRegistererDigitLeadingPrefix(t *testing.T) {
+	NewWithRegisterer("0", datastore.NewMapDatastore(), prometheus.NewRegistry())
+}
+
+// TestNewWithLabelsDigitLeadingPrefix is the NewWithLabels counterpart of
+// TestNewWithRegistererDigitLeadingPrefix: newLabeledPrometheusRecorder goes
+// through the same sanitizeMetricName helper.
+func TestNewWithLabelsDigitLeadingPrefix(t *testing.T) {
+	NewWithLabels("0", datastore.NewMapDatastore(), LabelOptions{Registerer: prometheus.NewRegistry()})
+}
+
+// TestObserveWithExemplar exercises the ObserveWithExemplar path in
+// observeWithExemplar end to end: an op performed under a context carrying
+// a sampled span should leave an exemplar with that span's trace id on the
+// latency histogram.
+func TestObserveWithExemplar(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	d := NewWithRegisterer("measure-exemplar", datastore.NewMapDatastore(), reg)
+
+	traceID, err := trace.TraceIDFromHex("0102030405060708090a0b0c0d0e0f10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spanID, err := trace.SpanIDFromHex("0102030405060708")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+
+	if err := d.Put(ctx, datastore.NewKey("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	mf := findMetricFamily(t, reg, "measure_exemplar_request_duration_seconds")
+	exemplar := findExemplar(t, mf)
+	if exemplar == nil {
+		t.Fatal("expected an exemplar on the latency histogram, found none")
+	}
+
+	var gotTraceID string
+	for _, l := range exemplar.Label {
+		if l.GetName() == "trace_id" {
+			gotTraceID = l.GetValue()
+		}
+	}
+	if gotTraceID != traceID.String() {
+		t.Errorf("exemplar trace_id = %q, want %q", gotTraceID, traceID.String())
+	}
+}
+
+func findMetricFamily(t *testing.T, g prometheus.Gatherer, name string) *dto.MetricFamily {
+	t.Helper()
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf
+		}
+	}
+	t.Fatalf("metric family %q not found", name)
+	return nil
+}
+
+func findExemplar(t *testing.T, mf *dto.MetricFamily) *dto.Exemplar {
+	t.Helper()
+	for _, m := range mf.GetMetric() {
+		for _, b := range m.GetHistogram().GetBucket() {
+			if b.Exemplar != nil {
+				return b.Exemplar
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package measure
+
+import (
+	"context"
+
+	"github.com/ipfs/go-datastore"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewWithTracer is like New, but additionally opens an OpenTelemetry span
+// around every Put, Get, Has, Delete, Query, and Batch.Commit call, linked
+// to whatever span (if any) is already present on the incoming
+// context.Context. This lets an IPFS node trace a block fetch end-to-end
+// through the datastore stack. Span attributes cover the key namespace,
+// value size, and (for batches) the number of puts/deletes committed.
+func NewWithTracer(prefix string, ds datastore.Datastore, tracer trace.Tracer) *measure {
+	m := New(prefix, ds)
+	m.tracer = tracer
+	return m
+}
+
+// DefaultTracer returns a trace.Tracer obtained from the globally
+// configured otel.GetTracerProvider(), named name. Pass it to
+// NewWithTracer so that wiring up a Jaeger/Tempo/etc. exporter elsewhere
+// in the program via otel.SetTracerProvider is enough to start collecting
+// traces, without this package needing any exporter-specific code.
+func DefaultTracer(name string) trace.Tracer {
+	return otel.GetTracerProvider().Tracer(name)
+}
+
+// startSpan opens a span named "measure."+op if m has a tracer configured
+// (via NewWithTracer), otherwise it's a no-op and span is nil. finishSpan
+// must be called with the result regardless.
+func (m *measure) startSpan(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if m.tracer == nil {
+		return ctx, nil
+	}
+	return m.tracer.Start(ctx, "measure."+op, trace.WithAttributes(attrs...))
+}
+
+func finishSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,107 @@
+package measure
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ErrTxnUnsupported is returned by NewTransaction if the wrapped backend
+// doesn't implement datastore.TxnDatastore.
+var ErrTxnUnsupported = errors.New("measure: backend does not support transactions")
+
+// NewTransaction implements datastore.TxnDatastore, forwarding to the
+// backend and wrapping the returned Txn so that operations performed
+// through it, and the transaction's own lifecycle (open, commit or
+// discard), are measured alongside everything else m tracks. It returns
+// ErrTxnUnsupported if the backend doesn't implement TxnDatastore.
+func (m *measure) NewTransaction(ctx context.Context, readOnly bool) (datastore.Txn, error) {
+	txnds, ok := m.backend.(datastore.TxnDatastore)
+	if !ok {
+		return nil, ErrTxnUnsupported
+	}
+
+	ctx, span := m.startSpan(ctx, "NewTransaction", attribute.Bool("ds.txn.read_only", readOnly))
+	txn, err := txnds.NewTransaction(ctx, readOnly)
+	finishSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	m.rec.recordTxnOpen()
+	return &measuredTxn{txn: txn, m: m, opened: time.Now()}, nil
+}
+
+// measuredTxn wraps a datastore.Txn, recording metrics for the operations
+// performed through it (scoped separately from m's top-level ops, see
+// recordTxnOp) as well as the transaction's own open-to-close duration.
+type measuredTxn struct {
+	txn datastore.Txn
+	m   *measure
+
+	opened time.Time
+}
+
+func (mt *measuredTxn) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	start := time.Now()
+	mt.m.rec.recordTxnOpSize("put", len(value))
+	err := mt.txn.Put(ctx, key, value)
+	mt.m.rec.recordTxnOp(ctx, "put", time.Since(start), err)
+	return err
+}
+
+func (mt *measuredTxn) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
+	start := time.Now()
+	value, err = mt.txn.Get(ctx, key)
+	if err == nil {
+		mt.m.rec.recordTxnOpSize("get", len(value))
+	}
+	mt.m.rec.recordTxnOp(ctx, "get", time.Since(start), err)
+	return value, err
+}
+
+func (mt *measuredTxn) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
+	start := time.Now()
+	exists, err = mt.txn.Has(ctx, key)
+	mt.m.rec.recordTxnOp(ctx, "has", time.Since(start), err)
+	return exists, err
+}
+
+func (mt *measuredTxn) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	start := time.Now()
+	size, err := mt.txn.GetSize(ctx, key)
+	mt.m.rec.recordTxnOp(ctx, "getsize", time.Since(start), err)
+	return size, err
+}
+
+func (mt *measuredTxn) Delete(ctx context.Context, key datastore.Key) error {
+	start := time.Now()
+	err := mt.txn.Delete(ctx, key)
+	mt.m.rec.recordTxnOp(ctx, "delete", time.Since(start), err)
+	return err
+}
+
+func (mt *measuredTxn) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	start := time.Now()
+	res, err := mt.txn.Query(ctx, q)
+	mt.m.rec.recordTxnOp(ctx, "query", time.Since(start), err)
+	return res, err
+}
+
+func (mt *measuredTxn) Commit(ctx context.Context) error {
+	ctx, span := mt.m.startSpan(ctx, "Txn.Commit")
+	start := time.Now()
+	err := mt.txn.Commit(ctx)
+	mt.m.rec.recordTxnCommit(time.Since(start), time.Since(mt.opened), err)
+	finishSpan(span, err)
+	return err
+}
+
+func (mt *measuredTxn) Discard(ctx context.Context) {
+	mt.txn.Discard(ctx)
+	mt.m.rec.recordTxnDiscard(time.Since(mt.opened))
+}